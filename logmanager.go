@@ -0,0 +1,262 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LogListEntry describes a single log as it appears in Google's
+// log_list.json schema, reduced to the fields LogManager needs.
+type LogListEntry struct {
+	Description string
+	URL         string
+	PublicKey   crypto.PublicKey
+	MMD         time.Duration
+
+	// Usable is true for logs in the "usable", "qualified" or "readonly"
+	// states, i.e. logs that a monitor should tail.
+	Usable bool
+
+	// FinalTreeSize is non-nil for "readonly" logs whose entry lists a
+	// final tree head, and gives the size of the log's final, frozen
+	// tree. It is nil for logs in every other state, including "retired".
+	FinalTreeSize *int64
+}
+
+// LogList is a parsed log_list.json.
+type LogList struct {
+	Logs []LogListEntry
+}
+
+type logListJSON struct {
+	Operators []struct {
+		Logs []struct {
+			Description string `json:"description"`
+			Key         string `json:"key"`
+			URL         string `json:"url"`
+			MMD         int64  `json:"mmd"`
+			State       map[string]struct {
+				FinalTreeHead *struct {
+					TreeSize int64 `json:"tree_size"`
+				} `json:"final_tree_head"`
+			} `json:"state"`
+		} `json:"logs"`
+	} `json:"operators"`
+}
+
+// ParseLogList parses the JSON body of a Google-format log_list.json.
+// Verifying the accompanying detached signature, if any, is the caller's
+// responsibility; ParseLogList only interprets the contents.
+func ParseLogList(data []byte) (*LogList, error) {
+	var raw logListJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing log list: %s", err)
+	}
+
+	list := &LogList{}
+	for _, operator := range raw.Operators {
+		for _, rawLog := range operator.Logs {
+			keyDER, err := base64.StdEncoding.DecodeString(rawLog.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing key for log %q: %s", rawLog.URL, err)
+			}
+			publicKey, err := x509.ParsePKIXPublicKey(keyDER)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing key for log %q: %s", rawLog.URL, err)
+			}
+
+			entry := LogListEntry{
+				Description: rawLog.Description,
+				URL:         rawLog.URL,
+				PublicKey:   publicKey,
+				MMD:         time.Duration(rawLog.MMD) * time.Second,
+			}
+			if _, ok := rawLog.State["usable"]; ok {
+				entry.Usable = true
+			}
+			if _, ok := rawLog.State["qualified"]; ok {
+				entry.Usable = true
+			}
+			if final, ok := rawLog.State["readonly"]; ok {
+				entry.Usable = true
+				if final.FinalTreeHead != nil {
+					treeSize := final.FinalTreeHead.TreeSize
+					entry.FinalTreeSize = &treeSize
+				}
+			}
+			// Logs in any other state (retired, rejected, pending) are
+			// left with Usable == false, and LogManager will not tail them.
+
+			list.Logs = append(list.Logs, entry)
+		}
+	}
+	return list, nil
+}
+
+// LogAddedFunc is called when LogManager starts tailing a log.
+type LogAddedFunc func(logURI string)
+
+// LogRemovedFunc is called when LogManager stops tailing a log, either
+// because the log list no longer includes it or because a Refresh finds
+// that it has reached its final tree size.
+type LogRemovedFunc func(logURI string)
+
+// LogErrorFunc is called when a log's Scanner exits with a fatal error.
+// The log is removed from LogManager after this is called.
+type LogErrorFunc func(logURI string, err error)
+
+// LogManagerOptions holds configuration for a LogManager.
+type LogManagerOptions struct {
+	// Options used for every Scanner that LogManager spawns.
+	ScannerOptions ScannerOptions
+
+	// NewStateStore returns the StateStore that should be used to
+	// persist and resume tailing progress for the given log.
+	NewStateStore func(logURI string) StateStore
+
+	// Called whenever a log starts being tailed, is no longer tailed,
+	// or its Scanner encounters a fatal error. Any of these may be nil.
+	LogAdded   LogAddedFunc
+	LogRemoved LogRemovedFunc
+	LogError   LogErrorFunc
+
+	// Called for every matching certificate found in any managed log.
+	ProcessCert ProcessCallback
+}
+
+type managedLog struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// LogManager tails every usable log in a log list, and adds or removes
+// Scanners as the list changes across calls to Refresh -- without the
+// caller having to restart the process.
+type LogManager struct {
+	opts LogManagerOptions
+
+	mu   sync.Mutex
+	logs map[string]*managedLog
+}
+
+// NewLogManager creates a LogManager that spawns Scanners according to
+// opts. Call Refresh to populate it from a log list.
+func NewLogManager(opts LogManagerOptions) *LogManager {
+	return &LogManager{
+		opts: opts,
+		logs: make(map[string]*managedLog),
+	}
+}
+
+// Refresh reconciles the set of tailed logs against list: logs that are
+// usable and not yet tailed are started, logs that are no longer usable
+// (retired, rejected, or removed from the list entirely) are stopped, and
+// logs that have already reached their final tree size are skipped, or
+// stopped if they were being tailed.
+func (m *LogManager) Refresh(list *LogList) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[string]bool, len(list.Logs))
+	for _, entry := range list.Logs {
+		if !entry.Usable {
+			continue
+		}
+		if entry.FinalTreeSize != nil && m.alreadyCaughtUp(entry) {
+			continue
+		}
+		wanted[entry.URL] = true
+		if _, alreadyManaged := m.logs[entry.URL]; alreadyManaged {
+			continue
+		}
+		m.startLog(entry)
+	}
+
+	for uri, log := range m.logs {
+		if !wanted[uri] {
+			log.cancel()
+			delete(m.logs, uri)
+			if m.opts.LogRemoved != nil {
+				m.opts.LogRemoved(uri)
+			}
+		}
+	}
+}
+
+// alreadyCaughtUp reports whether a readonly log's persisted state has
+// already reached its final tree size, in which case there's nothing
+// left for LogManager to do with it.
+func (m *LogManager) alreadyCaughtUp(entry LogListEntry) bool {
+	if m.opts.NewStateStore == nil {
+		return false
+	}
+	sth, err := m.opts.NewStateStore(entry.URL).Load()
+	if err != nil || sth == nil {
+		return false
+	}
+	return int64(sth.TreeSize) >= *entry.FinalTreeSize
+}
+
+func (m *LogManager) startLog(entry LogListEntry) {
+	scanner := NewScanner(entry.URL, entry.PublicKey, &m.opts.ScannerOptions)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	log := &managedLog{cancel: cancel, done: make(chan struct{})}
+	m.logs[entry.URL] = log
+
+	var state StateStore
+	if m.opts.NewStateStore != nil {
+		state = m.opts.NewStateStore(entry.URL)
+	}
+
+	go func() {
+		defer close(log.done)
+		// Poll no faster than the log's own MMD: it has no obligation to
+		// merge new entries in any less time than that.
+		err := scanner.Tail(ctx, state, m.opts.ProcessCert, entry.MMD)
+		if err != nil && err != context.Canceled {
+			if m.opts.LogError != nil {
+				m.opts.LogError(entry.URL, err)
+			}
+			m.mu.Lock()
+			if m.logs[entry.URL] == log {
+				delete(m.logs, entry.URL)
+			}
+			m.mu.Unlock()
+		}
+	}()
+
+	if m.opts.LogAdded != nil {
+		m.opts.LogAdded(entry.URL)
+	}
+}
+
+// Close stops tailing every managed log and waits for them to exit.
+func (m *LogManager) Close() {
+	m.mu.Lock()
+	logs := m.logs
+	m.logs = make(map[string]*managedLog)
+	m.mu.Unlock()
+
+	for _, log := range logs {
+		log.cancel()
+	}
+	for _, log := range logs {
+		<-log.done
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"crypto/x509"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MatchInfo carries the details of a match found by a Matcher, plus the
+// log-specific fields (LogURI, Index, LeafHash) that the Scanner fills in
+// itself, since a Matcher has no notion of which log or index it's
+// looking at.
+type MatchInfo struct {
+	LogURI    string
+	Index     int64
+	LeafHash  [32]byte
+	SANs      []string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Matcher decides whether a certificate is of interest to a monitor.
+// precert is true when cert was extracted from a CT precertificate entry
+// rather than a final, issued certificate.
+type Matcher interface {
+	Matches(cert *x509.Certificate, precert bool) (bool, MatchInfo)
+}
+
+// certMatchInfo builds the cert-derived fields of a MatchInfo; callers
+// fill in the log-specific fields afterwards.
+func certMatchInfo(cert *x509.Certificate) MatchInfo {
+	return MatchInfo{
+		SANs:      cert.DNSNames,
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+// MatchAll matches every certificate.
+type MatchAll struct{}
+
+func (MatchAll) Matches(cert *x509.Certificate, precert bool) (bool, MatchInfo) {
+	return true, certMatchInfo(cert)
+}
+
+// MatchExactDomains matches certificates that have at least one SAN
+// exactly equal (case-insensitively) to one of a fixed set of domains.
+type MatchExactDomains struct {
+	domains map[string]bool
+}
+
+// NewMatchExactDomains creates a MatchExactDomains matching the given
+// domains.
+func NewMatchExactDomains(domains []string) MatchExactDomains {
+	m := MatchExactDomains{domains: make(map[string]bool, len(domains))}
+	for _, domain := range domains {
+		m.domains[strings.ToLower(domain)] = true
+	}
+	return m
+}
+
+func (m MatchExactDomains) Matches(cert *x509.Certificate, precert bool) (bool, MatchInfo) {
+	for _, san := range cert.DNSNames {
+		if m.domains[strings.ToLower(san)] {
+			return true, certMatchInfo(cert)
+		}
+	}
+	return false, MatchInfo{}
+}
+
+// MatchWildcards matches certificates that have at least one SAN matching
+// one of a set of DNS wildcard patterns (e.g. "*.example.com"). Each "*"
+// label matches exactly one non-empty label, consistent with how "*" is
+// defined in a certificate's own SANs (RFC 6125) -- it does not match
+// across the "." that separates labels, so "*.example.com" matches
+// "foo.example.com" but not "example.com" or "foo.bar.example.com".
+type MatchWildcards struct {
+	patterns [][]string // each pattern, split into labels
+}
+
+// NewMatchWildcards creates a MatchWildcards matching the given patterns.
+func NewMatchWildcards(patterns []string) MatchWildcards {
+	split := make([][]string, len(patterns))
+	for i, pattern := range patterns {
+		split[i] = strings.Split(strings.ToLower(pattern), ".")
+	}
+	return MatchWildcards{patterns: split}
+}
+
+func (m MatchWildcards) Matches(cert *x509.Certificate, precert bool) (bool, MatchInfo) {
+	for _, san := range cert.DNSNames {
+		sanLabels := strings.Split(strings.ToLower(san), ".")
+		for _, patternLabels := range m.patterns {
+			if labelsMatch(patternLabels, sanLabels) {
+				return true, certMatchInfo(cert)
+			}
+		}
+	}
+	return false, MatchInfo{}
+}
+
+// labelsMatch reports whether name's labels match pattern's labels
+// label-for-label, treating a "*" pattern label as matching any single
+// non-empty name label.
+func labelsMatch(pattern, name []string) bool {
+	if len(pattern) != len(name) {
+		return false
+	}
+	for i, p := range pattern {
+		if p == "*" {
+			if name[i] == "" {
+				return false
+			}
+			continue
+		}
+		if p != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchRegex matches certificates that have at least one SAN matching a
+// regular expression.
+type MatchRegex struct {
+	re *regexp.Regexp
+}
+
+// NewMatchRegex creates a MatchRegex matching the given regular
+// expression against each SAN.
+func NewMatchRegex(re *regexp.Regexp) MatchRegex {
+	return MatchRegex{re: re}
+}
+
+func (m MatchRegex) Matches(cert *x509.Certificate, precert bool) (bool, MatchInfo) {
+	for _, san := range cert.DNSNames {
+		if m.re.MatchString(san) {
+			return true, certMatchInfo(cert)
+		}
+	}
+	return false, MatchInfo{}
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"crypto/x509"
+	"regexp"
+	"testing"
+)
+
+func TestMatchAll(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"example.com"}}
+	matched, info := (MatchAll{}).Matches(cert, false)
+	if !matched {
+		t.Fatal("MatchAll did not match a certificate")
+	}
+	if len(info.SANs) != 1 || info.SANs[0] != "example.com" {
+		t.Errorf("MatchInfo.SANs = %v, want [example.com]", info.SANs)
+	}
+}
+
+func TestMatchExactDomains(t *testing.T) {
+	m := NewMatchExactDomains([]string{"Example.com"})
+
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"example.com"}}, false); !matched {
+		t.Error("expected a case-insensitive exact match on example.com")
+	}
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"www.example.com"}}, false); matched {
+		t.Error("www.example.com should not match an exact domain matcher for example.com")
+	}
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"notexample.com"}}, false); matched {
+		t.Error("notexample.com should not match example.com")
+	}
+}
+
+func TestMatchWildcards(t *testing.T) {
+	m := NewMatchWildcards([]string{"*.example.com"})
+
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"www.example.com"}}, false); !matched {
+		t.Error("expected www.example.com to match *.example.com")
+	}
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"example.com"}}, false); matched {
+		t.Error("bare example.com should not match *.example.com")
+	}
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"a.b.example.com"}}, false); matched {
+		t.Error("*.example.com should not match more than one label of wildcard depth")
+	}
+}
+
+func TestMatchRegex(t *testing.T) {
+	m := NewMatchRegex(regexp.MustCompile(`^[a-z]+\.example\.com$`))
+
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"mail.example.com"}}, false); !matched {
+		t.Error("expected mail.example.com to match the regex")
+	}
+	if matched, _ := m.Matches(&x509.Certificate{DNSNames: []string{"mail2.example.com"}}, false); matched {
+		t.Error("mail2.example.com should not match [a-z]+.example.com")
+	}
+}
+
+func TestMatchersReportNoMatchInfoWhenUnmatched(t *testing.T) {
+	m := NewMatchExactDomains([]string{"example.com"})
+	matched, info := m.Matches(&x509.Certificate{DNSNames: []string{"other.com"}}, false)
+	if matched {
+		t.Fatal("expected no match")
+	}
+	if info.SANs != nil || info.Issuer != "" {
+		t.Errorf("MatchInfo = %+v, want the zero value when there's no match", info)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import "crypto/sha256"
+
+// ProgressMessage reports that every leaf from StartIndex to EndIndex,
+// inclusive, has been fetched, added to Scan's tree builder, and matched.
+// The leaves are not checked against a signed tree head's root hash
+// before the message is sent. A caller can persist the highest EndIndex
+// it has seen as its durable "processed up to here" checkpoint.
+type ProgressMessage struct {
+	StartIndex int64
+	EndIndex   int64
+
+	// LeafHashes holds the hash of every leaf in [StartIndex, EndIndex]
+	// in order, UNLESS Matches is empty, in which case it holds exactly
+	// one hash: the root of the subtree spanning those leaves. This
+	// keeps a long tail over a log with no hits from accumulating
+	// unbounded memory, while still letting a caller that did get a hit
+	// retain the individual leaf hashes it might need.
+	LeafHashes [][32]byte
+
+	Matches []MatchInfo
+	Errors  []error
+}
+
+// ProgressCallback is invoked once per completed chunk of ChunkSize
+// consecutive leaves, and once more when Scan returns for any leaves left
+// over, which may be fewer than ChunkSize.
+type ProgressCallback func(ProgressMessage)
+
+// merkleSubtreeRoot computes the RFC 6962 Merkle Tree Hash of leafHashes,
+// which are assumed to already be individual leaf hashes (i.e. each one
+// is the output of hashLeaf, not raw leaf data).
+func merkleSubtreeRoot(leafHashes [][32]byte) [32]byte {
+	if len(leafHashes) == 1 {
+		return leafHashes[0]
+	}
+	k := largestPowerOfTwoLessThan(len(leafHashes))
+	left := merkleSubtreeRoot(leafHashes[:k])
+	right := merkleSubtreeRoot(leafHashes[k:])
+	return merkleNodeHash(left, right)
+}
+
+// largestPowerOfTwoLessThan returns the largest power of two strictly
+// less than n, per the RFC 6962 MTH split point rule.
+func largestPowerOfTwoLessThan(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func merkleNodeHash(left, right [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestLargestPowerOfTwoLessThan(t *testing.T) {
+	cases := map[int]int{
+		2: 1,
+		3: 2,
+		4: 2,
+		5: 4,
+		7: 4,
+		8: 4,
+		9: 8,
+	}
+	for n, want := range cases {
+		if got := largestPowerOfTwoLessThan(n); got != want {
+			t.Errorf("largestPowerOfTwoLessThan(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestMerkleSubtreeRootSingleLeaf(t *testing.T) {
+	leaf := sha256.Sum256([]byte("leaf0"))
+	if got := merkleSubtreeRoot([][32]byte{leaf}); got != leaf {
+		t.Errorf("merkleSubtreeRoot of a single leaf = %x, want %x", got, leaf)
+	}
+}
+
+func TestMerkleSubtreeRootTwoLeaves(t *testing.T) {
+	leaf0 := sha256.Sum256([]byte("leaf0"))
+	leaf1 := sha256.Sum256([]byte("leaf1"))
+
+	got := merkleSubtreeRoot([][32]byte{leaf0, leaf1})
+	want := merkleNodeHash(leaf0, leaf1)
+	if got != want {
+		t.Errorf("merkleSubtreeRoot of two leaves = %x, want %x", got, want)
+	}
+}
+
+func TestMerkleSubtreeRootFourLeaves(t *testing.T) {
+	leaves := [4][32]byte{
+		sha256.Sum256([]byte("leaf0")),
+		sha256.Sum256([]byte("leaf1")),
+		sha256.Sum256([]byte("leaf2")),
+		sha256.Sum256([]byte("leaf3")),
+	}
+
+	got := merkleSubtreeRoot(leaves[:])
+	want := merkleNodeHash(
+		merkleNodeHash(leaves[0], leaves[1]),
+		merkleNodeHash(leaves[2], leaves[3]),
+	)
+	if got != want {
+		t.Errorf("merkleSubtreeRoot of four leaves = %x, want %x", got, want)
+	}
+}
+
+func TestMerkleNodeHashUsesRFC6962Prefix(t *testing.T) {
+	left := sha256.Sum256([]byte("left"))
+	right := sha256.Sum256([]byte("right"))
+
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	var want [32]byte
+	copy(want[:], h.Sum(nil))
+
+	if got := merkleNodeHash(left, right); got != want {
+		t.Errorf("merkleNodeHash = %x, want %x", got, want)
+	}
+}
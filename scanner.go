@@ -13,7 +13,8 @@
 package certspotter
 
 import (
-	//	"container/list"
+	"container/heap"
+	"context"
 	"crypto"
 	"errors"
 	"fmt"
@@ -28,6 +29,11 @@ import (
 
 type ProcessCallback func(*Scanner, *ct.LogEntry)
 
+// MatchCallback is invoked, in addition to the Scanner's ProcessCallback,
+// once per MatchInfo returned by a configured Matcher. An entry matched
+// by more than one Matcher triggers one call per match.
+type MatchCallback func(*Scanner, *ct.LogEntry, MatchInfo)
+
 const (
 	FETCH_RETRIES    = 10
 	FETCH_RETRY_WAIT = 1
@@ -41,6 +47,29 @@ type ScannerOptions struct {
 	// Number of concurrent proecssors to run
 	NumWorkers int
 
+	// Number of concurrent fetchers to run
+	NumFetchers int
+
+	// Matchers to run against every parsed certificate. If empty,
+	// processCert is invoked unconditionally for every entry, as before
+	// Matcher existed. If non-empty, each entry's X509Cert is matched
+	// exactly once (by Scan's assembler, before entries reach the
+	// processor workers or a ProgressMessage), and processCert is only
+	// invoked for entries that at least one Matcher matches; OnMatch, if
+	// set, additionally receives the MatchInfo for each match.
+	Matchers []Matcher
+	OnMatch  MatchCallback
+
+	// Number of consecutive leaves covered by each ProgressMessage,
+	// except the last one of a Scan, which may cover fewer.
+	ChunkSize int
+
+	// Invoked once per completed chunk of ChunkSize leaves, and once for
+	// the leftover leaves when Scan returns, so a caller
+	// can checkpoint how far it's gotten without holding every
+	// LeafHashes slice it's ever seen in memory. May be nil.
+	ProgressCallback ProgressCallback
+
 	// Don't print any status messages to stdout
 	Quiet bool
 }
@@ -48,9 +77,11 @@ type ScannerOptions struct {
 // Creates a new ScannerOptions struct with sensible defaults
 func DefaultScannerOptions() *ScannerOptions {
 	return &ScannerOptions{
-		BatchSize:  1000,
-		NumWorkers: 1,
-		Quiet:      false,
+		BatchSize:   1000,
+		NumWorkers:  1,
+		NumFetchers: 1,
+		ChunkSize:   1000,
+		Quiet:       false,
 	}
 }
 
@@ -78,70 +109,159 @@ type fetchRange struct {
 	end   int64
 }
 
+// matchedEntry pairs a ct.LogEntry with the matches the assembler already
+// found for it, so processerJob doesn't have to run the matchers a second
+// time.
+type matchedEntry struct {
+	entry   ct.LogEntry
+	matches []MatchInfo
+}
+
 // Worker function to process certs.
-// Accepts ct.LogEntries over the |entries| channel, and invokes processCert on them.
+// Accepts matchedEntrys over the |entries| channel, and invokes processCert on them
+// (when Matchers are configured, only on matched ones, after OnMatch).
 // Returns true over the |done| channel when the |entries| channel is closed.
-func (s *Scanner) processerJob(id int, entries <-chan ct.LogEntry, processCert ProcessCallback, wg *sync.WaitGroup) {
-	for entry := range entries {
+func (s *Scanner) processerJob(id int, entries <-chan matchedEntry, processCert ProcessCallback, wg *sync.WaitGroup) {
+	for me := range entries {
 		atomic.AddInt64(&s.certsProcessed, 1)
-		processCert(s, &entry)
+		if len(s.opts.Matchers) == 0 {
+			if processCert != nil {
+				processCert(s, &me.entry)
+			}
+			continue
+		}
+		if len(me.matches) == 0 {
+			continue
+		}
+		if s.opts.OnMatch != nil {
+			for _, info := range me.matches {
+				s.opts.OnMatch(s, &me.entry, info)
+			}
+		}
+		if processCert != nil {
+			processCert(s, &me.entry)
+		}
 	}
 	wg.Done()
 }
 
-func (s *Scanner) fetch(r fetchRange, entries chan<- ct.LogEntry, treeBuilder *MerkleTreeBuilder) error {
-	success := false
+// evaluateMatchers runs the certificate already held in entry.X509Cert
+// through every configured Matcher, returning every MatchInfo that
+// matched. It's the single place that decides what counts as a match, so
+// the entries handed to processCert/OnMatch and the matches reported in
+// ProgressMessages always agree. It does not parse entry.LeafBytes
+// itself: if entry.X509Cert is nil, it returns an error instead of
+// silently reporting no matches.
+func (s *Scanner) evaluateMatchers(entry *ct.LogEntry, leafHash [32]byte) ([]MatchInfo, error) {
+	if len(s.opts.Matchers) == 0 {
+		return nil, nil
+	}
+	cert := entry.X509Cert
+	if cert == nil {
+		return nil, fmt.Errorf("index %d: certificate could not be parsed", entry.Index)
+	}
+	precert := entry.Precert != nil
+	var matches []MatchInfo
+	for _, matcher := range s.opts.Matchers {
+		matched, info := matcher.Matches(cert, precert)
+		if !matched {
+			continue
+		}
+		info.LogURI = s.LogUri
+		info.Index = entry.Index
+		info.LeafHash = leafHash
+		matches = append(matches, info)
+	}
+	return matches, nil
+}
+
+// chunk holds the result of fetching a single fetchRange: the leaf hashes
+// and entries in index order, ready to be folded into a MerkleTreeBuilder
+// and handed to the processors once every earlier chunk has arrived.
+type chunk struct {
+	startIndex int64
+	leafHashes [][32]byte
+	entries    []ct.LogEntry
+	err        error
+}
+
+// chunkHeap is a container/heap of chunks ordered by startIndex, so the
+// assembler in Scan can always find the next chunk it's waiting for
+// without scanning every chunk that's arrived out of order.
+type chunkHeap []*chunk
+
+func (h chunkHeap) Len() int            { return len(h) }
+func (h chunkHeap) Less(i, j int) bool  { return h[i].startIndex < h[j].startIndex }
+func (h chunkHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x interface{}) { *h = append(*h, x.(*chunk)) }
+func (h *chunkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// fetchChunk fetches a single range from the log, retrying with
+// exponential backoff on transient errors. It stops early and returns
+// whatever it has so far if ctx is canceled.
+func (s *Scanner) fetchChunk(ctx context.Context, r fetchRange) *chunk {
+	c := &chunk{startIndex: r.start}
 	retries := FETCH_RETRIES
 	retryWait := FETCH_RETRY_WAIT
-	for !success {
+	for r.start <= r.end {
+		select {
+		case <-ctx.Done():
+			return c
+		default:
+		}
 		s.Log(fmt.Sprintf("Fetching entries %d to %d", r.start, r.end))
 		logEntries, err := s.logClient.GetEntries(r.start, r.end)
 		if err != nil {
 			if retries == 0 {
 				s.Warn(fmt.Sprintf("Problem fetching entries %d to %d from log: %s", r.start, r.end, err.Error()))
-				return err
-			} else {
-				s.Log(fmt.Sprintf("Problem fetching entries %d to %d from log (will retry): %s", r.start, r.end, err.Error()))
-				time.Sleep(time.Duration(retryWait) * time.Second)
-				retries--
-				retryWait *= 2
-				continue
+				c.err = err
+				return c
+			}
+			s.Log(fmt.Sprintf("Problem fetching entries %d to %d from log (will retry): %s", r.start, r.end, err.Error()))
+			if !sleepContext(ctx, time.Duration(retryWait)*time.Second) {
+				return c
 			}
+			retries--
+			retryWait *= 2
+			continue
 		}
 		retries = FETCH_RETRIES
 		retryWait = FETCH_RETRY_WAIT
 		for _, logEntry := range logEntries {
-			if treeBuilder != nil {
-				treeBuilder.Add(hashLeaf(logEntry.LeafBytes))
-			}
 			logEntry.Index = r.start
-			entries <- logEntry
+			c.leafHashes = append(c.leafHashes, hashLeaf(logEntry.LeafBytes))
+			c.entries = append(c.entries, logEntry)
 			r.start++
 		}
-		if r.start > r.end {
-			// Only complete if we actually got all the leaves we were
-			// expecting -- Logs MAY return fewer than the number of
-			// leaves requested.
-			success = true
-		}
 	}
-	return nil
+	return c
 }
 
-// Worker function for fetcher jobs.
-// Accepts cert ranges to fetch over the |ranges| channel, and if the fetch is
-// successful sends the individual LeafInputs out into the
-// |entries| channel for the processors to chew on.
-// Will retry failed attempts to retrieve ranges indefinitely.
-// Sends true over the |done| channel when the |ranges| channel is closed.
-/* disabled becuase error handling is broken
-func (s *Scanner) fetcherJob(id int, ranges <-chan fetchRange, entries chan<- ct.LogEntry, wg *sync.WaitGroup) {
+// fetcherJob pulls fetchRanges off the |ranges| channel and pushes the
+// resulting chunk onto |results|, in whatever order the fetches complete.
+// It stops, without draining |ranges|, as soon as ctx is canceled or it
+// hits an unrecoverable fetch error.
+func (s *Scanner) fetcherJob(ctx context.Context, ranges <-chan fetchRange, results chan<- *chunk, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for r := range ranges {
-		s.fetch(r, entries, nil)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		c := s.fetchChunk(ctx, r)
+		results <- c
+		if c.err != nil {
+			return
+		}
 	}
-	wg.Done()
 }
-*/
 
 // Returns the smaller of |a| and |b|
 func min(a int64, b int64) int64 {
@@ -232,7 +352,17 @@ func (s *Scanner) CheckConsistency(first *ct.SignedTreeHead, second *ct.SignedTr
 	return valid, treeBuilder, proof, nil
 }
 
-func (s *Scanner) Scan(startIndex int64, endIndex int64, processCert ProcessCallback, treeBuilder *MerkleTreeBuilder) error {
+// Scan fetches and processes every entry in [startIndex, endIndex). It
+// returns promptly with ctx.Err() if ctx is canceled, even if there's a
+// scan still in progress against a large range.
+//
+// Scan always returns the index one past the last entry it actually
+// delivered to processCert/OnMatch/ProgressCallback and added to
+// treeBuilder, whether or not it also returns an error. On success this
+// equals endIndex; on failure it lets the caller resume the scan at the
+// returned index instead of redoing (and redelivering) work that already
+// completed before the failure.
+func (s *Scanner) Scan(ctx context.Context, startIndex int64, endIndex int64, processCert ProcessCallback, treeBuilder *MerkleTreeBuilder) (int64, error) {
 	s.Log("Starting scan...")
 
 	s.certsProcessed = 0
@@ -251,26 +381,134 @@ func (s *Scanner) Scan(startIndex int64, endIndex int64, processCert ProcessCall
 	}()
 	*/
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Start processor workers
-	jobs := make(chan ct.LogEntry, 100)
+	jobs := make(chan matchedEntry, 100)
 	var processorWG sync.WaitGroup
 	for w := 0; w < s.opts.NumWorkers; w++ {
 		processorWG.Add(1)
 		go s.processerJob(w, jobs, processCert, &processorWG)
 	}
 
-	for start := startIndex; start < int64(endIndex); {
-		end := min(start+int64(s.opts.BatchSize), int64(endIndex)) - 1
-		if err := s.fetch(fetchRange{start, end}, jobs, treeBuilder); err != nil {
-			return err
+	// Start fetcher workers, pulling ranges off |ranges| and pushing
+	// completed chunks onto |results| as soon as each one is ready,
+	// regardless of order.
+	numFetchers := s.opts.NumFetchers
+	if numFetchers <= 0 {
+		numFetchers = 1
+	}
+	ranges := make(chan fetchRange, numFetchers)
+	results := make(chan *chunk, numFetchers)
+	var fetcherWG sync.WaitGroup
+	for f := 0; f < numFetchers; f++ {
+		fetcherWG.Add(1)
+		go s.fetcherJob(ctx, ranges, results, &fetcherWG)
+	}
+	go func() {
+		defer close(ranges)
+		for start := startIndex; start < int64(endIndex); {
+			end := min(start+int64(s.opts.BatchSize), int64(endIndex)) - 1
+			select {
+			case ranges <- fetchRange{start, end}:
+			case <-ctx.Done():
+				return
+			}
+			start = end + 1
+		}
+	}()
+	go func() {
+		fetcherWG.Wait()
+		close(results)
+	}()
+
+	// Reassemble chunks in log order with a min-heap keyed on startIndex,
+	// so the tree builder and the processors always see entries in
+	// strict order even though the fetchers complete out of order.
+	chunkSize := int64(s.opts.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = int64(s.opts.BatchSize)
+	}
+	progressStart := startIndex
+	var progressHashes [][32]byte
+	var progressMatches []MatchInfo
+	var progressErrors []error
+	flushProgress := func(endIndex int64) {
+		if s.opts.ProgressCallback == nil || len(progressHashes) == 0 {
+			return
+		}
+		msg := ProgressMessage{
+			StartIndex: progressStart,
+			EndIndex:   endIndex,
+			Matches:    progressMatches,
+			Errors:     progressErrors,
+		}
+		if len(progressMatches) == 0 {
+			msg.LeafHashes = [][32]byte{merkleSubtreeRoot(progressHashes)}
+		} else {
+			msg.LeafHashes = progressHashes
+		}
+		s.opts.ProgressCallback(msg)
+		progressStart = endIndex + 1
+		progressHashes = nil
+		progressMatches = nil
+		progressErrors = nil
+	}
+
+	var pending chunkHeap
+	next := startIndex
+	var fetchErr error
+	for c := range results {
+		if c.err != nil {
+			if fetchErr == nil {
+				fetchErr = c.err
+				cancel()
+			}
+			continue
+		}
+		heap.Push(&pending, c)
+		for len(pending) > 0 && pending[0].startIndex == next {
+			ready := heap.Pop(&pending).(*chunk)
+			for i, entry := range ready.entries {
+				if treeBuilder != nil {
+					treeBuilder.Add(ready.leafHashes[i])
+				}
+
+				matches, matchErr := s.evaluateMatchers(&entry, ready.leafHashes[i])
+				jobs <- matchedEntry{entry: entry, matches: matches}
+
+				if s.opts.ProgressCallback != nil {
+					progressHashes = append(progressHashes, ready.leafHashes[i])
+					progressMatches = append(progressMatches, matches...)
+					if matchErr != nil {
+						progressErrors = append(progressErrors, matchErr)
+					}
+					if int64(len(progressHashes)) >= chunkSize {
+						flushProgress(entry.Index)
+					}
+				}
+			}
+			next += int64(len(ready.entries))
 		}
-		start = end + 1
 	}
 	close(jobs)
 	processorWG.Wait()
+	flushProgress(next - 1)
+
+	if fetchErr == nil {
+		// ctx may have been canceled by our own caller rather than by a
+		// fetch error; either way, a canceled scan didn't finish and
+		// must not be reported as a success.
+		fetchErr = ctx.Err()
+	}
+	if fetchErr != nil {
+		return next, fetchErr
+	}
+
 	s.Log(fmt.Sprintf("Completed %d certs in %s", s.certsProcessed, humanTime(int(time.Since(startTime).Seconds()))))
 
-	return nil
+	return next, nil
 }
 
 // Creates a new Scanner instance using |client| to talk to the log, and taking
@@ -0,0 +1,54 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"container/heap"
+	"testing"
+)
+
+func TestChunkHeapOrdersByStartIndex(t *testing.T) {
+	starts := []int64{50, 10, 30, 0, 20}
+
+	var h chunkHeap
+	for _, start := range starts {
+		heap.Push(&h, &chunk{startIndex: start})
+	}
+
+	var got []int64
+	for h.Len() > 0 {
+		got = append(got, heap.Pop(&h).(*chunk).startIndex)
+	}
+
+	want := []int64{0, 10, 20, 30, 50}
+	if len(got) != len(want) {
+		t.Fatalf("popped %d chunks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pop order = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestChunkHeapPopsNothingWhenNextIsMissing(t *testing.T) {
+	// The assembler in Scan only pops once the chunk it wants is at the
+	// top of the heap; if startIndex 10 hasn't arrived yet, it must not
+	// be skipped over even though earlier-but-wrong chunks are present.
+	var h chunkHeap
+	heap.Push(&h, &chunk{startIndex: 20})
+	heap.Push(&h, &chunk{startIndex: 30})
+
+	const next = 10
+	if h[0].startIndex == next {
+		t.Fatalf("heap top is %d, did not expect it to equal the awaited index %d", h[0].startIndex, next)
+	}
+}
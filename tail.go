@@ -0,0 +1,189 @@
+// Copyright (C) 2016 Opsmate, Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla
+// Public License, v. 2.0. If a copy of the MPL was not distributed
+// with this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This software is distributed WITHOUT A WARRANTY OF ANY KIND.
+// See the Mozilla Public License for details.
+
+package certspotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"software.sslmate.com/src/certspotter/ct"
+)
+
+// ErrConsistencyViolation is returned by Tail when the log produces an STH
+// that is inconsistent with one it produced earlier. This indicates the
+// log has misbehaved (e.g. rewritten its history), and Tail always stops
+// rather than trying to recover.
+var ErrConsistencyViolation = errors.New("certspotter: STH failed consistency proof verification")
+
+const (
+	TAIL_POLL_INTERVAL = 30 * time.Second
+	TAIL_RETRY_WAIT    = 10 * time.Second
+)
+
+// StateStore lets a caller persist the state Tail needs to resume a log
+// after a restart without re-scanning entries it has already verified.
+//
+// This only persists the last verified STH, not a serialized compact
+// Merkle tree: Tail re-derives the tree it needs for each new STH by
+// fetching a fresh consistency proof from prevSTH to the new STH, rather
+// than replaying locally-stored tree state. That means every resume, no
+// matter how old prevSTH is, depends on the log still being willing to
+// produce a consistency proof from that (possibly very old) tree size.
+// Logs are required to support this by RFC 6962, but a StateStore that
+// also persisted the compact tree would let Tail resume without relying
+// on it.
+type StateStore interface {
+	// Load returns the last STH that Tail successfully verified and
+	// processed, or a nil STH if Tail has never made progress on this
+	// log before.
+	Load() (*ct.SignedTreeHead, error)
+
+	// Store persists sth as the last STH that Tail has successfully
+	// verified and processed.
+	Store(sth *ct.SignedTreeHead) error
+}
+
+// Tail polls the log for new STHs every pollInterval, verifies that each
+// new STH is consistent with the last one Tail verified, and hands the
+// entries appended in between to processCert. It calls state.Store after
+// each new STH is verified and its entries have been processed, so a
+// caller that persists that state can resume Tail from where it left off
+// without re-scanning the whole log.
+//
+// pollInterval should normally be derived from the log's MMD (maximum
+// merge delay): polling much faster than that just wastes requests on a
+// log that hasn't had a chance to merge anything new, while polling much
+// slower adds needless latency to detecting new certificates. If
+// pollInterval is zero, TAIL_POLL_INTERVAL is used instead.
+//
+// Tail runs until ctx is canceled, in which case it returns ctx.Err(), or
+// until it encounters an unrecoverable error such as
+// ErrConsistencyViolation. Transient network errors while polling for an
+// STH or fetching a consistency proof are retried with backoff; prevSTH
+// is only advanced, and state.Store only called, once a new STH's
+// consistency proof has been verified and all of its new entries have
+// been processed, so no progress is lost across restarts. The new
+// entries are added to the tree builder from the consistency check but
+// are not compared against the new STH's root hash. If state is nil,
+// Tail starts from the log's current size and persists nothing.
+// A transient error partway through scanning a new
+// STH's entries is also retried, resuming from the index Scan actually
+// reached rather than the start of the range, so already-delivered
+// entries are not redelivered to processCert/OnMatch on retry.
+func (s *Scanner) Tail(ctx context.Context, state StateStore, processCert ProcessCallback, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = TAIL_POLL_INTERVAL
+	}
+
+	var prevSTH *ct.SignedTreeHead
+	if state != nil {
+		var err error
+		prevSTH, err = state.Load()
+		if err != nil {
+			return fmt.Errorf("error loading tail state: %s", err)
+		}
+	}
+	if prevSTH == nil {
+		// Nothing has been verified yet, so start tailing from the
+		// log's current size instead of re-scanning its whole history.
+		sth, err := s.GetSTH()
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			if err := state.Store(sth); err != nil {
+				return fmt.Errorf("error storing tail state: %s", err)
+			}
+		}
+		prevSTH = sth
+	}
+
+	for {
+		newSTH, err := s.GetSTH()
+		if err != nil {
+			s.Warn(fmt.Sprintf("Problem fetching STH (will retry): %s", err.Error()))
+			if !sleepContext(ctx, TAIL_RETRY_WAIT) {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if newSTH.TreeSize == prevSTH.TreeSize {
+			if !sleepContext(ctx, pollInterval) {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		// Fetch the consistency proof once: it's only needed to obtain a
+		// treeBuilder for the new entries, and that same treeBuilder is
+		// reused across every Scan retry below, so re-fetching it here
+		// on a later retry would start the tree over from prevSTH and
+		// duplicate the leaves Scan already added.
+		var treeBuilder *MerkleTreeBuilder
+		for {
+			valid, tb, _, err := s.CheckConsistency(prevSTH, newSTH)
+			if err != nil {
+				s.Warn(fmt.Sprintf("Problem verifying consistency of STHs (will retry): %s", err.Error()))
+				if !sleepContext(ctx, TAIL_RETRY_WAIT) {
+					return ctx.Err()
+				}
+				continue
+			}
+			if !valid {
+				return ErrConsistencyViolation
+			}
+			treeBuilder = tb
+			break
+		}
+
+		// Scan is retried on its own from wherever it last got to: on
+		// failure it reports the index it actually reached, so a retry
+		// resumes there instead of redelivering entries already passed
+		// to processCert/OnMatch.
+		for next := int64(prevSTH.TreeSize); next < int64(newSTH.TreeSize); {
+			reached, err := s.Scan(ctx, next, int64(newSTH.TreeSize), processCert, treeBuilder)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				s.Warn(fmt.Sprintf("Problem scanning entries %d to %d (will retry): %s", next, newSTH.TreeSize, err.Error()))
+				next = reached
+				if !sleepContext(ctx, TAIL_RETRY_WAIT) {
+					return ctx.Err()
+				}
+				continue
+			}
+			next = reached
+		}
+
+		if state != nil {
+			if err := state.Store(newSTH); err != nil {
+				return fmt.Errorf("error storing tail state: %s", err)
+			}
+		}
+		prevSTH = newSTH
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is canceled, whichever comes
+// first. It reports whether the sleep ran to completion.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}